@@ -0,0 +1,170 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit records a session-level trail of everything that passes
+// through the proxy: connection lifecycle, client identity, the backend
+// node chosen for each statement, the statement itself and its outcome.
+// It is intentionally decoupled from how that trail is persisted -- the
+// Logger fans each event out to one or more Sink implementations,
+// selected and configured via the `audit` section of the proxy
+// configuration.
+package audit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fx-hao/crunchy-proxy/config"
+	"github.com/fx-hao/crunchy-proxy/util/log"
+)
+
+// EventType identifies the kind of audit event being recorded.
+type EventType string
+
+const (
+	EventConnect    EventType = "connect"
+	EventDisconnect EventType = "disconnect"
+	EventStatement  EventType = "statement"
+	EventError      EventType = "error"
+)
+
+// StatementType mirrors the PostgreSQL wire message that produced a
+// statement event, so log consumers can tell a simple query apart from
+// an extended-protocol Parse/Bind/Execute.
+type StatementType byte
+
+const (
+	StatementSimpleQuery StatementType = 'Q'
+	StatementParse       StatementType = 'P'
+	StatementBind        StatementType = 'B'
+	StatementExecute     StatementType = 'E'
+)
+
+// Event is a single audited fact about a session. Not every field is set
+// for every EventType; for example RowCount and Error only apply once a
+// backend has responded to a statement.
+type Event struct {
+	Time       time.Time     `json:"time"`
+	Type       EventType     `json:"type"`
+	SessionID  string        `json:"session_id"`
+	ClientAddr string        `json:"client_addr"`
+	Username   string        `json:"username"`
+	Database   string        `json:"database"`
+	Node       string        `json:"node,omitempty"`
+	Statement  StatementType `json:"statement,omitempty"`
+	Query      string        `json:"query,omitempty"`
+	RowCount   int64         `json:"row_count,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// Sink persists Events. Implementations must be safe for concurrent use,
+// since the proxy serves many sessions at once.
+type Sink interface {
+	Write(Event) error
+	Close() error
+}
+
+// Logger fans an Event out to every configured Sink. A Sink error is
+// logged but never propagated to the caller -- a misbehaving audit
+// backend must not interrupt query processing.
+type Logger struct {
+	sinks  []Sink
+	redact bool
+	lock   sync.Mutex
+}
+
+// NewLogger builds a Logger from the `audit` section of the proxy
+// configuration. It returns nil, which is safe to call methods on, if
+// auditing is disabled.
+func NewLogger() *Logger {
+	if !config.GetBool("audit.enable") {
+		return nil
+	}
+
+	l := &Logger{
+		redact: config.GetBool("audit.redact_literals"),
+	}
+
+	for _, kind := range config.GetStringSlice("audit.outputs") {
+		sink, err := newSink(kind)
+		if err != nil {
+			log.Errorf("Error configuring audit sink '%s'", kind)
+			log.Errorf("Error: %s", err.Error())
+			continue
+		}
+		l.sinks = append(l.sinks, sink)
+	}
+
+	return l
+}
+
+func newSink(kind string) (Sink, error) {
+	switch kind {
+	case "file":
+		return NewJSONFileSink(config.GetString("audit.file.path"))
+	case "rotated-file":
+		return NewRotatingFileSink(
+			config.GetString("audit.rotated_file.path"),
+			config.GetInt("audit.rotated_file.max_size_mb"),
+			config.GetInt("audit.rotated_file.max_backups"),
+		)
+	case "syslog":
+		return NewSyslogSink(config.GetString("audit.syslog.tag"))
+	default:
+		return nil, fmt.Errorf("unknown audit output '%s'", kind)
+	}
+}
+
+// Log records ev on every configured sink. It is a no-op on a nil
+// Logger so callers don't need to guard every call with an enabled
+// check.
+func (l *Logger) Log(ev Event) {
+	if l == nil {
+		return
+	}
+
+	if l.redact && ev.Query != "" {
+		ev.Query = redactLiterals(ev.Query)
+	}
+
+	ev.Time = time.Now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, sink := range l.sinks {
+		if err := sink.Write(ev); err != nil {
+			log.Errorf("Error writing audit event to sink")
+			log.Errorf("Error: %s", err.Error())
+		}
+	}
+}
+
+// Close shuts down every configured sink, flushing any buffered state.
+func (l *Logger) Close() {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil {
+			log.Errorf("Error closing audit sink")
+			log.Errorf("Error: %s", err.Error())
+		}
+	}
+}
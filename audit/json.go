@@ -0,0 +1,55 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// JSONFileSink appends one JSON object per line to a file, the
+// conventional format for log shippers such as filebeat or fluentd.
+type JSONFileSink struct {
+	file    *os.File
+	encoder *json.Encoder
+	lock    sync.Mutex
+}
+
+// NewJSONFileSink opens (or creates) path for appending.
+func NewJSONFileSink(path string) (*JSONFileSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONFileSink{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// Write appends ev to the file as a single JSON line.
+func (s *JSONFileSink) Write(ev Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.encoder.Encode(ev)
+}
+
+// Close closes the underlying file.
+func (s *JSONFileSink) Close() error {
+	return s.file.Close()
+}
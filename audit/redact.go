@@ -0,0 +1,31 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import "regexp"
+
+// redactLiterals replaces single-quoted string literals and bare numeric
+// literals in a SQL statement with a placeholder, so audit logs can
+// record that a query ran without retaining the values it carried.
+func redactLiterals(query string) string {
+	query = stringLiteralPattern.ReplaceAllString(query, "'?'")
+	query = numericLiteralPattern.ReplaceAllString(query, "?")
+	return query
+}
+
+var (
+	stringLiteralPattern  = regexp.MustCompile(`'(?:[^'\\]|\\.)*'`)
+	numericLiteralPattern = regexp.MustCompile(`\b\d+(\.\d+)?\b`)
+)
@@ -0,0 +1,124 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFileSink is an append-only JSON-lines sink that rotates the
+// active file once it reaches maxSize bytes, keeping at most maxBackups
+// previous files around. With maxBackups <= 0 the active file is never
+// renamed aside and keeps growing past maxSize. Rotated files are never
+// rewritten, only renamed aside and replaced, so the audit trail can't
+// be tampered with by truncation.
+type RotatingFileSink struct {
+	path        string
+	maxSize     int64
+	maxBackups  int
+	lock        sync.Mutex
+	file        *os.File
+	encoder     *json.Encoder
+	currentSize int64
+}
+
+// NewRotatingFileSink opens (or creates) path for appending and rotates
+// it according to maxSizeMB and maxBackups.
+func NewRotatingFileSink(path string, maxSizeMB int, maxBackups int) (*RotatingFileSink, error) {
+	s := &RotatingFileSink{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *RotatingFileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.encoder = json.NewEncoder(file)
+	s.currentSize = info.Size()
+
+	return nil
+}
+
+// Write appends ev to the active file, rotating first if it has grown
+// past the configured size threshold.
+func (s *RotatingFileSink) Write(ev Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.maxSize > 0 && s.currentSize >= s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	buf = append(buf, '\n')
+
+	n, err := s.file.Write(buf)
+	s.currentSize += int64(n)
+
+	return err
+}
+
+func (s *RotatingFileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	for i := s.maxBackups - 1; i > 0; i-- {
+		older := fmt.Sprintf("%s.%d", s.path, i)
+		newer := fmt.Sprintf("%s.%d", s.path, i+1)
+		os.Rename(older, newer)
+	}
+
+	if s.maxBackups > 0 {
+		os.Rename(s.path, fmt.Sprintf("%s.1", s.path))
+	}
+
+	return s.open()
+}
+
+// Close closes the active file.
+func (s *RotatingFileSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.file.Close()
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// SyslogSink writes each event as a JSON-encoded message at the 'info'
+// syslog priority, under the local0 facility conventionally used for
+// application-defined logging.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to the local syslog daemon, tagging every
+// message with tag.
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyslogSink{writer: writer}, nil
+}
+
+// Write sends ev to syslog.
+func (s *SyslogSink) Write(ev Event) error {
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	return s.writer.Info(string(buf))
+}
+
+// Close closes the connection to the syslog daemon.
+func (s *SyslogSink) Close() error {
+	return s.writer.Close()
+}
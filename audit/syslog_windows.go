@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import "fmt"
+
+// SyslogSink is unavailable on Windows, which has no syslog daemon.
+// NewSyslogSink always returns an error on this platform.
+type SyslogSink struct{}
+
+// NewSyslogSink always fails on Windows.
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	return nil, fmt.Errorf("audit: syslog output is not supported on windows")
+}
+
+// Write is never called since construction always fails.
+func (s *SyslogSink) Write(ev Event) error { return nil }
+
+// Close is never called since construction always fails.
+func (s *SyslogSink) Close() error { return nil }
@@ -0,0 +1,189 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package balancer chooses which read pool a query is routed to.
+// Previously Proxy.getPool simply pulled the next pool off a channel,
+// which amounts to round robin with no awareness of load, lag, or
+// affinity. A Strategy replaces that channel with a registry that can
+// be updated at runtime -- nodes added/removed, marked healthy or
+// unhealthy, reweighted, or have their observed lag refreshed -- while
+// still answering Next() in whatever way the chosen strategy sees fit.
+package balancer
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/fx-hao/crunchy-proxy/pool"
+)
+
+// ErrNoPools is returned by Next when no healthy pool is registered.
+var ErrNoPools = errors.New("balancer: no healthy pools registered")
+
+// Strategy selects which pool.Pool a read should be routed to.
+// Implementations must be safe for concurrent use.
+type Strategy interface {
+	// Register adds or replaces the pool registered under name.
+	Register(name string, p *pool.Pool, weight int)
+
+	// Unregister removes name from the registry.
+	Unregister(name string)
+
+	// Lookup returns the pool registered under name, if any. It exists
+	// for promoteReplica, which needs to pull a specific replica's pool
+	// back out of the registry in order to hand it to the write side.
+	Lookup(name string) (*pool.Pool, bool)
+
+	// Names returns the names of every currently registered pool,
+	// healthy or not.
+	Names() []string
+
+	// SetHealthy marks name healthy or unhealthy. Next never returns an
+	// unhealthy pool.
+	SetHealthy(name string, healthy bool)
+
+	// SetLag records name's most recently observed replication lag, in
+	// bytes, for strategies that take it into account.
+	SetLag(name string, lagBytes int64)
+
+	// Next selects a pool for a read. annotation is the shard key
+	// parsed from a `/* shard=<key> */` query comment, if any; only
+	// ConsistentHash uses it.
+	Next(annotation string) (*pool.Pool, error)
+}
+
+// New constructs the Strategy named by kind. Unknown names fall back to
+// round robin, matching the proxy's previous channel-based behavior.
+func New(kind string) Strategy {
+	switch kind {
+	case "least-connections":
+		return NewLeastConnections()
+	case "weighted-random":
+		return NewWeightedRandom()
+	case "lowest-lag":
+		return NewLowestLag()
+	case "consistent-hash":
+		return NewConsistentHash()
+	default:
+		return NewRoundRobin()
+	}
+}
+
+// entry is the bookkeeping a registry keeps alongside each registered
+// pool.
+type entry struct {
+	name    string
+	pool    *pool.Pool
+	weight  int
+	healthy bool
+	lag     int64
+}
+
+// registry implements the Register/Unregister/SetHealthy/SetLag
+// bookkeeping shared by every Strategy, leaving only Next's selection
+// logic to each implementation.
+type registry struct {
+	lock    sync.RWMutex
+	entries map[string]*entry
+}
+
+func newRegistry() registry {
+	return registry{entries: make(map[string]*entry)}
+}
+
+func (r *registry) Register(name string, p *pool.Pool, weight int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if weight <= 0 {
+		weight = 1
+	}
+
+	r.entries[name] = &entry{name: name, pool: p, weight: weight, healthy: true}
+}
+
+func (r *registry) Unregister(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.entries, name)
+}
+
+func (r *registry) Lookup(name string) (*pool.Pool, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	e, ok := r.entries[name]
+	if !ok {
+		return nil, false
+	}
+
+	return e.pool, true
+}
+
+func (r *registry) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (r *registry) SetHealthy(name string, healthy bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if e, ok := r.entries[name]; ok {
+		e.healthy = healthy
+	}
+}
+
+func (r *registry) SetLag(name string, lagBytes int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if e, ok := r.entries[name]; ok {
+		e.lag = lagBytes
+	}
+}
+
+// healthyEntries returns a snapshot, sorted by name for a stable
+// iteration order, of every currently healthy entry. Each entry is
+// copied by value while the lock is held, rather than handing out the
+// *entry stored in the map, so a Strategy's Next reading e.lag/e.weight
+// afterwards can't race SetLag/Register writing the live entry.
+func (r *registry) healthyEntries() []entry {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := make([]string, 0, len(r.entries))
+	for name, e := range r.entries {
+		if e.healthy {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	healthy := make([]entry, 0, len(names))
+	for _, name := range names {
+		healthy = append(healthy, *r.entries[name])
+	}
+
+	return healthy
+}
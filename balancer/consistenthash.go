@@ -0,0 +1,70 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"github.com/fx-hao/crunchy-proxy/pool"
+)
+
+// ConsistentHash pins every query carrying the same `/* shard=<key> */`
+// annotation to the same replica, for cache locality, by walking a ring
+// of healthy pools hashed by name and picking the first one at or past
+// the hash of the shard key.
+type ConsistentHash struct {
+	registry
+}
+
+// NewConsistentHash returns an empty ConsistentHash strategy.
+func NewConsistentHash() *ConsistentHash {
+	return &ConsistentHash{registry: newRegistry()}
+}
+
+// Next returns the pool the ring assigns to annotation. An empty
+// annotation (no shard key on the query) falls back to the first
+// healthy pool in the ring, so unsharded queries still get a
+// deterministic choice.
+func (b *ConsistentHash) Next(annotation string) (*pool.Pool, error) {
+	entries := b.healthyEntries()
+	if len(entries) == 0 {
+		return nil, ErrNoPools
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return hashKey(entries[i].name) < hashKey(entries[j].name)
+	})
+
+	if annotation == "" {
+		return entries[0].pool, nil
+	}
+
+	key := hashKey(annotation)
+
+	for _, e := range entries {
+		if hashKey(e.name) >= key {
+			return e.pool, nil
+		}
+	}
+
+	return entries[0].pool, nil
+}
+
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
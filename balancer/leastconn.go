@@ -0,0 +1,46 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import "github.com/fx-hao/crunchy-proxy/pool"
+
+// LeastConnections routes to whichever healthy pool currently has the
+// fewest checked-out connections, using each pool.Pool's own in-use
+// count.
+type LeastConnections struct {
+	registry
+}
+
+// NewLeastConnections returns an empty LeastConnections strategy.
+func NewLeastConnections() *LeastConnections {
+	return &LeastConnections{registry: newRegistry()}
+}
+
+// Next returns the least-loaded healthy pool.
+func (b *LeastConnections) Next(annotation string) (*pool.Pool, error) {
+	entries := b.healthyEntries()
+	if len(entries) == 0 {
+		return nil, ErrNoPools
+	}
+
+	best := entries[0]
+	for _, e := range entries[1:] {
+		if e.pool.InUse() < best.pool.InUse() {
+			best = e
+		}
+	}
+
+	return best.pool, nil
+}
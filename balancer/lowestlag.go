@@ -0,0 +1,47 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import "github.com/fx-hao/crunchy-proxy/pool"
+
+// LowestLag routes to whichever healthy pool has the smallest
+// replication lag most recently reported by the health subsystem via
+// SetLag. It's meant for workloads that would rather wait on a pool
+// pick than read stale data off a far-behind replica.
+type LowestLag struct {
+	registry
+}
+
+// NewLowestLag returns an empty LowestLag strategy.
+func NewLowestLag() *LowestLag {
+	return &LowestLag{registry: newRegistry()}
+}
+
+// Next returns the healthy pool with the lowest last-reported lag.
+func (b *LowestLag) Next(annotation string) (*pool.Pool, error) {
+	entries := b.healthyEntries()
+	if len(entries) == 0 {
+		return nil, ErrNoPools
+	}
+
+	best := entries[0]
+	for _, e := range entries[1:] {
+		if e.lag < best.lag {
+			best = e
+		}
+	}
+
+	return best.pool, nil
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"sync/atomic"
+
+	"github.com/fx-hao/crunchy-proxy/pool"
+)
+
+// RoundRobin cycles through every healthy registered pool in turn. It
+// matches the behavior Proxy.getPool had before the balancer package
+// existed, when pools were pulled off a channel.
+type RoundRobin struct {
+	registry
+	next uint64
+}
+
+// NewRoundRobin returns an empty RoundRobin strategy.
+func NewRoundRobin() *RoundRobin {
+	return &RoundRobin{registry: newRegistry()}
+}
+
+// Next returns the next pool in rotation.
+func (b *RoundRobin) Next(annotation string) (*pool.Pool, error) {
+	entries := b.healthyEntries()
+	if len(entries) == 0 {
+		return nil, ErrNoPools
+	}
+
+	i := atomic.AddUint64(&b.next, 1)
+
+	return entries[i%uint64(len(entries))].pool, nil
+}
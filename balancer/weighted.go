@@ -0,0 +1,67 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package balancer
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/fx-hao/crunchy-proxy/pool"
+)
+
+// WeightedRandom picks a healthy pool at random, weighted by the
+// weight it was registered (or reweighted) with, so operators can send
+// replicas with more capacity a proportionally larger share of reads.
+type WeightedRandom struct {
+	registry
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// NewWeightedRandom returns an empty WeightedRandom strategy.
+func NewWeightedRandom() *WeightedRandom {
+	return &WeightedRandom{
+		registry: newRegistry(),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next returns a pool chosen at random, weighted by each healthy
+// entry's registered weight.
+func (b *WeightedRandom) Next(annotation string) (*pool.Pool, error) {
+	entries := b.healthyEntries()
+	if len(entries) == 0 {
+		return nil, ErrNoPools
+	}
+
+	total := 0
+	for _, e := range entries {
+		total += e.weight
+	}
+
+	b.lock.Lock()
+	pick := b.rand.Intn(total)
+	b.lock.Unlock()
+
+	for _, e := range entries {
+		pick -= e.weight
+		if pick < 0 {
+			return e.pool, nil
+		}
+	}
+
+	return entries[len(entries)-1].pool, nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connect
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/fx-hao/crunchy-proxy/config"
+	crunchytls "github.com/fx-hao/crunchy-proxy/tls"
+	"github.com/fx-hao/crunchy-proxy/util/log"
+)
+
+// backendCipherSuites restricts the cipher suites offered when
+// connecting to a backend to a conservative, modern set.
+var backendCipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+}
+
+var (
+	terminationOnce  sync.Once
+	terminationCache *crunchytls.Cache
+)
+
+// terminationCA loads the CA the proxy uses to mint per-client leaf
+// certificates and builds the cache that mints/caches them, according
+// to the `tls.ca_cert`/`tls.ca_key` configuration. It is initialized
+// once and reused for the life of the process.
+func terminationCA() *crunchytls.Cache {
+	terminationOnce.Do(func() {
+		ca, err := crunchytls.LoadCA(
+			config.GetString("tls.ca_cert"),
+			config.GetString("tls.ca_key"),
+		)
+
+		if err != nil {
+			log.Error("Error loading TLS termination CA.")
+			log.Errorf("Error: %s", err.Error())
+			return
+		}
+
+		terminationCache = crunchytls.NewCache(ca, config.GetInt("tls.cert_cache_size"))
+	})
+
+	return terminationCache
+}
+
+// UpgradeServerConnection upgrades the server side of a client
+// connection to TLS, acting as a full terminator rather than a
+// pass-through: a leaf certificate is minted on demand (and cached) for
+// whatever SNI hostname the client presents, signed by the proxy's
+// configured CA. This lets the proxy decrypt and inspect queries in
+// cleartext before the message-relay loop sends them on to a backend.
+func UpgradeServerConnection(connection net.Conn) net.Conn {
+	cache := terminationCA()
+	if cache == nil {
+		log.Error("TLS termination CA is not configured; refusing to upgrade client connection")
+		return connection
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			host := hello.ServerName
+			if host == "" {
+				host = config.GetString("tls.default_host")
+			}
+			return cache.Get(host)
+		},
+	}
+
+	server := tls.Server(connection, tlsConfig)
+
+	if err := server.Handshake(); err != nil {
+		log.Error("Error performing TLS handshake with client.")
+		log.Errorf("Error: %s", err.Error())
+		return connection
+	}
+
+	return server
+}
+
+// UpgradeClientConnection upgrades the backend leg of a connection to
+// TLS once the proxy has decided to re-encrypt traffic to host. It uses
+// strong settings -- a TLS 1.2 floor, a restricted cipher suite list,
+// and full verification of the backend's certificate -- since this leg
+// is no longer mediated by the CA used for client-facing termination.
+func UpgradeClientConnection(host string, connection net.Conn) net.Conn {
+	serverName, _, err := net.SplitHostPort(host)
+	if err != nil {
+		serverName = host
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS12,
+		CipherSuites:       backendCipherSuites,
+		InsecureSkipVerify: false,
+	}
+
+	if pool := backendRootCAs(); pool != nil {
+		tlsConfig.RootCAs = pool
+	}
+
+	client := tls.Client(connection, tlsConfig)
+
+	if err := client.Handshake(); err != nil {
+		log.Error("Error performing TLS handshake with backend.")
+		log.Errorf("Error: %s", err.Error())
+		return connection
+	}
+
+	return client
+}
+
+// backendRootCAs returns the root CA pool used to verify backend
+// certificates, if `tls.backend_root_ca` is configured. A nil pool
+// falls back to the system's default trust store.
+func backendRootCAs() *x509.CertPool {
+	path := config.GetString("tls.backend_root_ca")
+	if path == "" {
+		return nil
+	}
+
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		log.Errorf("Error reading backend root CA '%s'", path)
+		log.Errorf("Error: %s", err.Error())
+		return nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	pool.AppendCertsFromPEM(pem)
+
+	return pool
+}
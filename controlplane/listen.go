@@ -0,0 +1,41 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controlplane
+
+import (
+	"net"
+
+	"google.golang.org/grpc"
+
+	"github.com/fx-hao/crunchy-proxy/controlplane/pb"
+	"github.com/fx-hao/crunchy-proxy/proxy"
+	"github.com/fx-hao/crunchy-proxy/util/log"
+)
+
+// Serve starts the control-plane gRPC service for p, listening on addr.
+// It blocks until the listener fails or the gRPC server is stopped.
+func Serve(p *proxy.Proxy, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterControlPlaneServer(grpcServer, NewServer(p))
+
+	log.Infof("Control plane: listening on %s", addr)
+
+	return grpcServer.Serve(listener)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package controlplane implements the gRPC service defined in
+// controlplane.proto (generated into the sibling `pb` package by
+// `protoc`), letting an external controller push node membership,
+// credential, and capacity changes into a running proxy without a
+// restart.
+package controlplane
+
+import (
+	"context"
+	"time"
+
+	"github.com/fx-hao/crunchy-proxy/common"
+	"github.com/fx-hao/crunchy-proxy/controlplane/pb"
+	"github.com/fx-hao/crunchy-proxy/proxy"
+	"github.com/fx-hao/crunchy-proxy/util/log"
+)
+
+// defaultStatsInterval is used for a StreamStats call that doesn't
+// specify one.
+const defaultStatsInterval = 5 * time.Second
+
+// Server implements pb.ControlPlaneServer against a running Proxy.
+type Server struct {
+	pb.UnimplementedControlPlaneServer
+
+	proxy *proxy.Proxy
+}
+
+// NewServer returns a control-plane Server that mutates p.
+func NewServer(p *proxy.Proxy) *Server {
+	return &Server{proxy: p}
+}
+
+// AddNode connects a new node and adds it to rotation.
+func (s *Server) AddNode(ctx context.Context, req *pb.AddNodeRequest) (*pb.AddNodeResponse, error) {
+	s.proxy.AddNode(req.Name, common.Node{
+		HostPort: req.HostPort,
+		Role:     nodeRole(req.Role),
+	})
+
+	return &pb.AddNodeResponse{}, nil
+}
+
+// RemoveNode takes a node out of rotation immediately.
+func (s *Server) RemoveNode(ctx context.Context, req *pb.RemoveNodeRequest) (*pb.RemoveNodeResponse, error) {
+	s.proxy.RemoveNode(req.Name)
+	return &pb.RemoveNodeResponse{}, nil
+}
+
+// DrainNode quiesces in-flight sessions against a node before removing
+// it, up to the requested timeout.
+func (s *Server) DrainNode(ctx context.Context, req *pb.DrainNodeRequest) (*pb.DrainNodeResponse, error) {
+	timeout := time.Duration(req.TimeoutSeconds) * time.Second
+	drained := s.proxy.DrainNode(req.Name, timeout)
+
+	return &pb.DrainNodeResponse{Drained: drained}, nil
+}
+
+// ReloadCredentials updates the credentials used to authenticate
+// backend connections.
+func (s *Server) ReloadCredentials(ctx context.Context, req *pb.ReloadCredentialsRequest) (*pb.ReloadCredentialsResponse, error) {
+	s.proxy.ReloadCredentials(req.Username, req.Password, req.Database)
+	return &pb.ReloadCredentialsResponse{}, nil
+}
+
+// StreamStats emits a NodeStats update for every known node at the
+// requested interval until the client disconnects.
+func (s *Server) StreamStats(req *pb.StreamStatsRequest, stream pb.ControlPlane_StreamStatsServer) error {
+	interval := time.Duration(req.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultStatsInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-ticker.C:
+			for _, stat := range s.proxy.NodeStats() {
+				err := stream.Send(&pb.NodeStats{
+					Name:     stat.Name,
+					Queries:  int64(stat.Queries),
+					LagBytes: stat.LagBytes,
+					Healthy:  stat.Healthy,
+				})
+
+				if err != nil {
+					log.Debugf("Control plane: error streaming stats for '%s'", stat.Name)
+					log.Debugf("Error: %s", err.Error())
+					return err
+				}
+			}
+		}
+	}
+}
+
+func nodeRole(role pb.NodeRole) common.NodeRole {
+	if role == pb.NodeRole_MASTER {
+		return common.NODE_ROLE_MASTER
+	}
+	return common.NODE_ROLE_REPLICA
+}
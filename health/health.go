@@ -0,0 +1,441 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package health periodically probes pooled backend connections to
+// track which nodes are reachable, how far a replica has fallen behind
+// its master, and how long a probe round-trip takes. Proxy.getPool
+// consults this to skip nodes that have gone unhealthy or whose
+// replication lag has crossed a configured threshold, turning the
+// previously static master/replica split into a topology that can
+// react to a backend going away.
+package health
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fx-hao/crunchy-proxy/common"
+	"github.com/fx-hao/crunchy-proxy/connect"
+	"github.com/fx-hao/crunchy-proxy/pool"
+	"github.com/fx-hao/crunchy-proxy/protocol"
+	"github.com/fx-hao/crunchy-proxy/util/log"
+)
+
+// DefaultProbeQuery asks a node whether it is currently a replica in
+// recovery. It is cheap and side-effect free, making it safe to run on
+// every pooled connection on every tick.
+const DefaultProbeQuery = "SELECT pg_is_in_recovery();"
+
+// DefaultLagQuery reports how far a replica has replayed the WAL
+// stream it is receiving from its master.
+const DefaultLagQuery = "SELECT pg_last_wal_replay_lsn();"
+
+// DefaultMasterLSNQuery reports the master's current WAL write
+// position, which each replica's DefaultLagQuery result is subtracted
+// from to get an actual lag, rather than an absolute offset.
+const DefaultMasterLSNQuery = "SELECT pg_current_wal_lsn();"
+
+// Status is the most recently observed health of a single node.
+type Status struct {
+	Healthy    bool
+	InRecovery bool
+	LagBytes   int64
+	RTT        time.Duration
+	LastCheck  time.Time
+	Err        error
+}
+
+type node struct {
+	name string
+	role common.NodeRole
+	pool *pool.Pool
+}
+
+// Checker periodically probes every registered node's pool and tracks
+// the resulting Status. A single Checker is shared by the whole proxy.
+type Checker struct {
+	interval       time.Duration
+	lagThreshold   int64
+	probeQuery     string
+	lagQuery       string
+	masterLSNQuery string
+
+	lock   sync.RWMutex
+	nodes  map[string]*node
+	status map[string]*Status
+
+	onMasterLoss func(replacement string)
+	onUpdate     func(name string, status Status)
+
+	stop chan struct{}
+}
+
+// NewChecker returns a Checker that probes every registered node every
+// interval. A non-positive interval falls back to 5 seconds.
+func NewChecker(interval time.Duration, lagThreshold int64) *Checker {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	return &Checker{
+		interval:       interval,
+		lagThreshold:   lagThreshold,
+		probeQuery:     DefaultProbeQuery,
+		lagQuery:       DefaultLagQuery,
+		masterLSNQuery: DefaultMasterLSNQuery,
+		nodes:          make(map[string]*node),
+		status:         make(map[string]*Status),
+		stop:           make(chan struct{}),
+	}
+}
+
+// SetProbeQuery overrides the query used to determine whether a node is
+// reachable and, for replicas, still in recovery.
+func (c *Checker) SetProbeQuery(query string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.probeQuery = query
+}
+
+// OnMasterLoss registers a hook invoked with the name of the
+// lowest-lag healthy replica whenever the master is found unhealthy.
+// Only one replacement is proposed per unhealthy tick; it is up to the
+// caller to actually promote the pool.
+func (c *Checker) OnMasterLoss(hook func(replacement string)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onMasterLoss = hook
+}
+
+// OnUpdate registers a hook invoked with every node's latest Status
+// after each probe round, so callers such as a balancer.Strategy can
+// keep their own health/lag bookkeeping in sync without polling.
+func (c *Checker) OnUpdate(hook func(name string, status Status)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onUpdate = hook
+}
+
+// Register adds a node's pool to the set of nodes probed on every
+// tick. Registering a name that already exists replaces it, which
+// setupPools/AddPool rely on when a node's pool is recreated.
+func (c *Checker) Register(name string, role common.NodeRole, p *pool.Pool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.nodes[name] = &node{name: name, role: role, pool: p}
+	c.status[name] = &Status{Healthy: true}
+}
+
+// Unregister removes a node from the probed set, e.g. once a node is
+// drained and removed from the pool.
+func (c *Checker) Unregister(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.nodes, name)
+	delete(c.status, name)
+}
+
+// IsHealthy reports whether name's most recent probe succeeded and, if
+// it's a replica, whether its lag is within the configured threshold.
+// An unregistered or never-probed node is treated as healthy so that a
+// node isn't excluded before its first probe has run.
+func (c *Checker) IsHealthy(name string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	status, ok := c.status[name]
+	if !ok {
+		return true
+	}
+
+	if !status.Healthy {
+		return false
+	}
+
+	if c.lagThreshold > 0 && status.LagBytes > c.lagThreshold {
+		return false
+	}
+
+	return true
+}
+
+// Status returns a copy of the most recently observed status for name.
+func (c *Checker) Status(name string) Status {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if status, ok := c.status[name]; ok {
+		return *status
+	}
+
+	return Status{}
+}
+
+// Start runs the probe loop until Stop is called. It is meant to be run
+// in its own goroutine.
+func (c *Checker) Start() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.probeAll()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Stop halts the probe loop started by Start.
+func (c *Checker) Stop() {
+	close(c.stop)
+}
+
+func (c *Checker) probeAll() {
+	c.lock.RLock()
+	nodes := make([]*node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		nodes = append(nodes, n)
+	}
+	c.lock.RUnlock()
+
+	masterLSN, haveMasterLSN := c.probeMasterLSN(nodes)
+
+	for _, n := range nodes {
+		c.probe(n, masterLSN, haveMasterLSN)
+	}
+
+	c.checkMasterLoss(nodes)
+}
+
+// probeMasterLSN looks up the registered master and queries its current
+// WAL write position, so probe can turn each replica's own WAL replay
+// position into an actual lag behind the master instead of an absolute
+// offset. It reports false if there's no registered master or the
+// query fails.
+func (c *Checker) probeMasterLSN(nodes []*node) (int64, bool) {
+	for _, n := range nodes {
+		if n.role != common.NODE_ROLE_MASTER {
+			continue
+		}
+
+		conn, err := checkout(n.pool)
+		if err != nil {
+			return 0, false
+		}
+
+		value, err := runScalarQuery(conn, c.masterLSNQuery)
+		n.pool.Return(conn)
+		if err != nil {
+			return 0, false
+		}
+
+		lsn, err := lsnToBytes(value)
+		if err != nil {
+			return 0, false
+		}
+
+		return lsn, true
+	}
+
+	return 0, false
+}
+
+func (c *Checker) probe(n *node, masterLSN int64, haveMasterLSN bool) {
+	status := &Status{LastCheck: time.Now()}
+
+	conn, err := checkout(n.pool)
+	if err != nil {
+		status.Err = err
+		c.setStatus(n.name, status)
+		return
+	}
+	defer n.pool.Return(conn)
+
+	start := time.Now()
+	inRecovery, err := probeInRecovery(conn, c.probeQuery)
+	status.RTT = time.Since(start)
+
+	if err != nil {
+		status.Healthy = false
+		status.Err = err
+		logFailure(n.name, err)
+		c.setStatus(n.name, status)
+		return
+	}
+
+	status.Healthy = true
+	status.InRecovery = inRecovery
+
+	if n.role != common.NODE_ROLE_MASTER && haveMasterLSN {
+		if replicaLSN, err := probeLSN(conn, c.lagQuery); err == nil {
+			status.LagBytes = lagBytes(masterLSN, replicaLSN)
+		}
+	}
+
+	c.setStatus(n.name, status)
+}
+
+// checkout acquires a connection from p through its normal checkout
+// path, the same one a client session's cp.Next() uses, so a probe
+// never grabs a connection another session currently holds. The caller
+// is responsible for returning it via p.Return once done.
+func checkout(p *pool.Pool) (net.Conn, error) {
+	if len(p.Conns()) == 0 {
+		return nil, errNoConnections
+	}
+
+	return p.Next(), nil
+}
+
+// lagBytes turns a replica's WAL replay position into how far behind
+// the master it is. A replica can briefly appear ahead of a master LSN
+// sampled moments earlier, so that's clamped to zero rather than
+// reported as negative lag.
+func lagBytes(masterLSN, replicaLSN int64) int64 {
+	lag := masterLSN - replicaLSN
+	if lag < 0 {
+		return 0
+	}
+
+	return lag
+}
+
+func (c *Checker) setStatus(name string, status *Status) {
+	c.lock.Lock()
+	c.status[name] = status
+	hook := c.onUpdate
+	c.lock.Unlock()
+
+	if hook != nil {
+		hook(name, *status)
+	}
+}
+
+// checkMasterLoss looks for a registered master node that is currently
+// unhealthy and, if a promotion hook is configured, proposes the
+// lowest-lag healthy replica as its replacement.
+func (c *Checker) checkMasterLoss(nodes []*node) {
+	c.lock.RLock()
+	hook := c.onMasterLoss
+	c.lock.RUnlock()
+
+	if hook == nil {
+		return
+	}
+
+	var masterHealthy = true
+	var haveMaster bool
+
+	for _, n := range nodes {
+		if n.role == common.NODE_ROLE_MASTER {
+			haveMaster = true
+			masterHealthy = c.IsHealthy(n.name)
+		}
+	}
+
+	if !haveMaster || masterHealthy {
+		return
+	}
+
+	best := c.lowestLagReplica(nodes)
+	if best != "" {
+		hook(best)
+	}
+}
+
+func (c *Checker) lowestLagReplica(nodes []*node) string {
+	var best string
+	var bestLag int64 = -1
+
+	for _, n := range nodes {
+		if n.role == common.NODE_ROLE_MASTER || !c.IsHealthy(n.name) {
+			continue
+		}
+
+		status := c.Status(n.name)
+
+		if bestLag == -1 || status.LagBytes < bestLag {
+			best = n.name
+			bestLag = status.LagBytes
+		}
+	}
+
+	return best
+}
+
+func probeInRecovery(conn net.Conn, query string) (bool, error) {
+	value, err := runScalarQuery(conn, query)
+	if err != nil {
+		return false, err
+	}
+
+	return value == "t", nil
+}
+
+// probeLSN runs query (expected to return a single LSN column, such as
+// DefaultLagQuery or DefaultMasterLSNQuery) and parses the result into
+// an absolute byte offset.
+func probeLSN(conn net.Conn, query string) (int64, error) {
+	value, err := runScalarQuery(conn, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return lsnToBytes(value)
+}
+
+func runScalarQuery(conn net.Conn, query string) (string, error) {
+	if _, err := connect.Send(conn, protocol.CreateQueryMessage(query)); err != nil {
+		return "", err
+	}
+
+	for {
+		message, length, err := connect.Receive(conn)
+		if err != nil {
+			return "", err
+		}
+
+		for start := 0; start < length; {
+			messageType := protocol.GetMessageType(message[start:])
+			messageLength := protocol.GetMessageLength(message[start:])
+
+			if messageType == protocol.DataRowMessageType {
+				value := firstColumnValue(message[start:])
+				return value, nil
+			}
+
+			if messageType == protocol.ErrorResponseMessageType {
+				return "", newProbeError(message[start:])
+			}
+
+			start = start + int(messageLength) + 1
+
+			if messageType == protocol.ReadyForQueryMessageType {
+				return "", errNoRows
+			}
+		}
+	}
+}
+
+// logFailure is a small helper so probe failures show up the same way
+// other connection errors do elsewhere in the proxy.
+func logFailure(name string, err error) {
+	log.Debugf("Health probe failed for node '%s'", name)
+	log.Debugf("Error: %s", err.Error())
+}
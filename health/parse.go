@@ -0,0 +1,99 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	errNoConnections = errors.New("health: node has no pooled connections to probe")
+	errNoRows        = errors.New("health: probe query returned no rows")
+)
+
+// newProbeError turns an ErrorResponse message's primary 'M' field into
+// a Go error.
+func newProbeError(message []byte) error {
+	if len(message) < 5 {
+		return errors.New("health: malformed error response")
+	}
+
+	payload := message[5:]
+
+	for len(payload) > 1 {
+		code := payload[0]
+		idx := bytes.IndexByte(payload[1:], 0)
+		if idx < 0 {
+			break
+		}
+
+		value := string(payload[1 : 1+idx])
+		payload = payload[1+idx+1:]
+
+		if code == 'M' {
+			return errors.New(value)
+		}
+	}
+
+	return errors.New("health: probe query failed")
+}
+
+// firstColumnValue extracts the text value of the first column from a
+// DataRow message.
+func firstColumnValue(message []byte) string {
+	if len(message) < 7 {
+		return ""
+	}
+
+	/* Skip type(1) + length(4) + field count(2). */
+	payload := message[7:]
+
+	if len(payload) < 4 {
+		return ""
+	}
+
+	columnLength := int(int32(payload[0])<<24 | int32(payload[1])<<16 | int32(payload[2])<<8 | int32(payload[3]))
+	if columnLength < 0 || 4+columnLength > len(payload) {
+		return ""
+	}
+
+	return string(payload[4 : 4+columnLength])
+}
+
+// lsnToBytes converts a PostgreSQL LSN of the form "16/B374D848" into
+// an absolute byte offset suitable for comparing replication lag
+// between nodes.
+func lsnToBytes(lsn string) (int64, error) {
+	parts := strings.SplitN(strings.TrimSpace(lsn), "/", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("health: malformed LSN '%s'", lsn)
+	}
+
+	high, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	low, err := strconv.ParseInt(parts[1], 16, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return (high << 32) | low, nil
+}
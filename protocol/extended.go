@@ -0,0 +1,165 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package protocol
+
+import (
+	"bytes"
+	"sync"
+)
+
+// PreparedStatement is a named (or unnamed, name == "") statement
+// created by a frontend Parse message.
+type PreparedStatement struct {
+	Name  string
+	Query string
+}
+
+// Portal binds a PreparedStatement to parameter values via a frontend
+// Bind message.
+type Portal struct {
+	Name      string
+	Statement string
+}
+
+// ExtendedQueryState tracks the prepared statements and portals a
+// single client connection has created via the extended query protocol
+// (Parse/Bind/Describe/Execute/Sync), so that the proxy can keep
+// pinning the right backend across a Parse->Bind->Execute->Sync
+// sequence and still recover the original SQL text for annotation-based
+// routing.
+type ExtendedQueryState struct {
+	lock       sync.Mutex
+	statements map[string]*PreparedStatement
+	portals    map[string]*Portal
+}
+
+// NewExtendedQueryState returns an empty ExtendedQueryState for a new
+// client connection.
+func NewExtendedQueryState() *ExtendedQueryState {
+	return &ExtendedQueryState{
+		statements: make(map[string]*PreparedStatement),
+		portals:    make(map[string]*Portal),
+	}
+}
+
+// HandleParse records the statement created by a Parse message and
+// returns it so its query text can be inspected for annotations.
+func (s *ExtendedQueryState) HandleParse(message []byte) *PreparedStatement {
+	body := messageBody(message)
+
+	name, rest := readCString(body)
+	query, _ := readCString(rest)
+
+	stmt := &PreparedStatement{Name: name, Query: query}
+
+	s.lock.Lock()
+	s.statements[name] = stmt
+	s.lock.Unlock()
+
+	return stmt
+}
+
+// HandleBind records the portal created by a Bind message, binding it
+// to the statement it was parsed from.
+func (s *ExtendedQueryState) HandleBind(message []byte) *Portal {
+	body := messageBody(message)
+
+	portalName, rest := readCString(body)
+	statementName, _ := readCString(rest)
+
+	portal := &Portal{Name: portalName, Statement: statementName}
+
+	s.lock.Lock()
+	s.portals[portalName] = portal
+	s.lock.Unlock()
+
+	return portal
+}
+
+// HandleClose removes the statement or portal named by a Close message
+// from the tracked state.
+func (s *ExtendedQueryState) HandleClose(message []byte) {
+	body := messageBody(message)
+	if len(body) < 1 {
+		return
+	}
+
+	kind := body[0]
+	name, _ := readCString(body[1:])
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch kind {
+	case 'S':
+		delete(s.statements, name)
+	case 'P':
+		delete(s.portals, name)
+	}
+}
+
+// StatementForPortal returns the prepared statement bound to portalName,
+// if any.
+func (s *ExtendedQueryState) StatementForPortal(portalName string) *PreparedStatement {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	portal, ok := s.portals[portalName]
+	if !ok {
+		return nil
+	}
+
+	return s.statements[portal.Statement]
+}
+
+// Statements returns every prepared statement currently tracked, so the
+// caller can mirror their creation onto other pooled backends.
+func (s *ExtendedQueryState) Statements() []*PreparedStatement {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	statements := make([]*PreparedStatement, 0, len(s.statements))
+	for _, stmt := range s.statements {
+		statements = append(statements, stmt)
+	}
+
+	return statements
+}
+
+// messageBody strips the leading type byte and 4-byte length field off
+// a frontend message, returning just its payload.
+func messageBody(message []byte) []byte {
+	if len(message) < 5 {
+		return nil
+	}
+
+	length := int(GetMessageLength(message))
+	if length+1 > len(message) {
+		length = len(message) - 1
+	}
+
+	return message[5 : length+1]
+}
+
+// readCString reads a null-terminated string off the front of buf,
+// returning the string and the remaining bytes after the terminator.
+func readCString(buf []byte) (string, []byte) {
+	idx := bytes.IndexByte(buf, 0)
+	if idx < 0 {
+		return string(buf), nil
+	}
+
+	return string(buf[:idx]), buf[idx+1:]
+}
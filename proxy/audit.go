@@ -0,0 +1,95 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/fx-hao/crunchy-proxy/protocol"
+)
+
+// commandCompleteRowCount extracts the row count from a CommandComplete
+// message's tag, e.g. "UPDATE 3" or "SELECT 12". Tags that have no
+// trailing count, such as "BEGIN" or "CREATE TABLE", return ok == false.
+func commandCompleteRowCount(message []byte) (int64, bool) {
+	tag := commandTag(message)
+	if tag == "" {
+		return 0, false
+	}
+
+	fields := strings.Fields(tag)
+	if len(fields) == 0 {
+		return 0, false
+	}
+
+	count, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return count, true
+}
+
+// commandTag returns the null-terminated tag payload of a
+// CommandComplete message.
+func commandTag(message []byte) string {
+	if len(message) < 5 {
+		return ""
+	}
+
+	end := 1 + int(protocol.GetMessageLength(message))
+	if end > len(message) {
+		return ""
+	}
+	payload := message[5:end]
+
+	if idx := strings.IndexByte(string(payload), 0); idx >= 0 {
+		return string(payload[:idx])
+	}
+
+	return string(payload)
+}
+
+// errorResponseMessage extracts the primary human-readable message (the
+// 'M' field) from an ErrorResponse message.
+func errorResponseMessage(message []byte) string {
+	if len(message) < 5 {
+		return ""
+	}
+
+	end := 1 + int(protocol.GetMessageLength(message))
+	if end > len(message) {
+		return ""
+	}
+	payload := message[5:end]
+
+	for len(payload) > 1 {
+		code := payload[0]
+		idx := strings.IndexByte(string(payload[1:]), 0)
+		if idx < 0 {
+			break
+		}
+
+		value := string(payload[1 : 1+idx])
+		payload = payload[1+idx+1:]
+
+		if code == 'M' {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"time"
+
+	"github.com/fx-hao/crunchy-proxy/common"
+	"github.com/fx-hao/crunchy-proxy/config"
+	"github.com/fx-hao/crunchy-proxy/pool"
+	"github.com/fx-hao/crunchy-proxy/util/log"
+)
+
+// NodeStats is a snapshot of a single node's counters, handed to a
+// control-plane controller so it can drive placement decisions.
+type NodeStats struct {
+	Name     string
+	Queries  int32
+	LagBytes int64
+	Healthy  bool
+}
+
+// AddNode brings a new node online at runtime. It is the entry point
+// the gRPC control-plane service calls to satisfy an AddNode RPC.
+func (p *Proxy) AddNode(name string, node common.Node) {
+	log.Infof("Control plane: adding node '%s' at %s", name, node.HostPort)
+	p.AddPool(name, node)
+}
+
+// RemoveNode takes a node out of rotation immediately, without waiting
+// for in-flight sessions against it to finish. Callers that need a
+// graceful removal should use DrainNode instead.
+func (p *Proxy) RemoveNode(name string) {
+	log.Infof("Control plane: removing node '%s'", name)
+	p.RemovePool(name)
+}
+
+// DrainNode marks name as draining -- getPool stops handing its pool
+// out to new sessions, except that a draining write pool is still
+// returned when no other write pool is usable -- and waits up to
+// timeout for its pooled
+// connections to become idle before removing it. It reports whether
+// the node quiesced before the timeout elapsed; either way, the node is
+// removed once DrainNode returns.
+func (p *Proxy) DrainNode(name string, timeout time.Duration) bool {
+	pl := p.poolNamed(name)
+	if pl == nil {
+		log.Errorf("Control plane: cannot drain unknown node '%s'", name)
+		return false
+	}
+
+	p.lock.Lock()
+	if p.draining == nil {
+		p.draining = make(map[string]bool)
+	}
+	p.draining[name] = true
+	p.lock.Unlock()
+
+	/*
+	 * getWritePool consults isDraining directly, but read pools are
+	 * selected from the balancer registry, which has no notion of
+	 * draining -- marking the pool unhealthy there keeps it out of
+	 * rotation for the same reason.
+	 */
+	p.readBalancer.SetHealthy(name, false)
+
+	defer func() {
+		p.lock.Lock()
+		delete(p.draining, name)
+		p.lock.Unlock()
+	}()
+
+	quiesced := waitForIdle(pl, timeout)
+	if !quiesced {
+		log.Errorf("Control plane: timed out draining node '%s', removing anyway", name)
+	}
+
+	p.RemovePool(name)
+
+	return quiesced
+}
+
+func waitForIdle(pl *pool.Pool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for pl.InUse() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return true
+}
+
+// ReloadCredentials updates the credentials the proxy authenticates
+// backend connections with. Connections already established keep using
+// whatever credentials they authenticated with; the new credentials
+// apply the next time a node is (re)connected, e.g. via AddNode or a
+// future restart of a drained node.
+func (p *Proxy) ReloadCredentials(username, password, database string) {
+	log.Info("Control plane: reloading credentials")
+
+	config.Set("credentials.username", username)
+	config.Set("credentials.password", password)
+	config.Set("credentials.database", database)
+}
+
+// NodeStats returns a snapshot of every currently known node's query
+// count, replication lag, and health, for streaming to a control-plane
+// controller.
+func (p *Proxy) NodeStats() []NodeStats {
+	p.lock.Lock()
+	queries := make(map[string]int32, len(p.Stats))
+	for name, count := range p.Stats {
+		queries[name] = count
+	}
+	p.lock.Unlock()
+
+	names := p.poolNames()
+
+	stats := make([]NodeStats, 0, len(names))
+	for _, name := range names {
+		status := p.health.Status(name)
+		stats = append(stats, NodeStats{
+			Name:     name,
+			Queries:  queries[name],
+			LagBytes: status.LagBytes,
+			Healthy:  p.health.IsHealthy(name),
+		})
+	}
+
+	return stats
+}
+
+// poolNamed returns the pool registered under name, if any, without
+// removing it from rotation.
+func (p *Proxy) poolNamed(name string) *pool.Pool {
+	if pl, ok := p.readBalancer.Lookup(name); ok {
+		return pl
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	existing := drainPools(p.writePools)
+
+	var found *pool.Pool
+	for _, pl := range existing {
+		if pl.Name == name {
+			found = pl
+		}
+		p.writePools <- pl
+	}
+
+	return found
+}
+
+// poolNames returns the names of every currently registered pool.
+func (p *Proxy) poolNames() []string {
+	names := p.readBalancer.Names()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	existing := drainPools(p.writePools)
+	for _, pl := range existing {
+		names = append(names, pl.Name)
+		p.writePools <- pl
+	}
+
+	return names
+}
+
+// isDraining reports whether name has been marked draining by
+// DrainNode and should no longer be handed out to new sessions.
+func (p *Proxy) isDraining(name string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.draining[name]
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"net"
+
+	"github.com/fx-hao/crunchy-proxy/connect"
+	"github.com/fx-hao/crunchy-proxy/pool"
+	"github.com/fx-hao/crunchy-proxy/protocol"
+	"github.com/fx-hao/crunchy-proxy/util/log"
+)
+
+// isExtendedProtocolMessageType reports whether messageType is part of
+// the extended query protocol (Parse/Bind/Describe/Execute/Sync/Close/
+// Flush), as opposed to a simple 'Q' query or a startup/termination
+// message.
+func isExtendedProtocolMessageType(messageType byte) bool {
+	switch messageType {
+	case protocol.ParseMessageType,
+		protocol.BindMessageType,
+		protocol.DescribeMessageType,
+		protocol.ExecuteMessageType,
+		protocol.SyncMessageType,
+		protocol.CloseMessageType,
+		protocol.FlushMessageType:
+		return true
+	default:
+		return false
+	}
+}
+
+// mirrorParseToPool sends the Parse message that created a prepared
+// statement on primary to every other idle connection in cp, so that a
+// later Execute against a different pooled connection for the same
+// node still finds the statement it names. Each other connection is
+// checked out via cp.TryNext(), a non-blocking checkout, rather than
+// cp.Next(): with several extended-protocol sessions in flight at
+// once, each already holding its own primary checked out, the pool can
+// be fully checked out when a mirror runs, and a blocking Next() here
+// would wait forever for a connection none of those sessions is about
+// to return. A connection TryNext can't find right now is simply left
+// unmirrored -- an Execute against the unmirrored statement on that
+// connection gets an error from the backend, which is relayed to the
+// client, rather than the session wedging.
+func mirrorParseToPool(cp *pool.Pool, primary net.Conn, parseMessage []byte) {
+	size := len(cp.Conns())
+
+	for i := 0; i < size-1; i++ {
+		backend, ok := cp.TryNext()
+		if !ok {
+			log.Debugf("Skipping prepared statement mirror on pool '%s': no idle connections", cp.Name)
+			return
+		}
+
+		if backend == primary {
+			cp.Return(backend)
+			continue
+		}
+
+		if err := mirrorParse(backend, parseMessage); err != nil {
+			log.Debugf("Error mirroring prepared statement to backend %s", backend.RemoteAddr())
+			log.Debugf("Error: %s", err.Error())
+		}
+
+		cp.Return(backend)
+	}
+}
+
+// mirrorParse sends parseMessage followed by a Sync to backend and
+// drains its response through ReadyForQuery. Sync is what actually
+// guarantees a reply to a Parse; without it the mirrored connection
+// would never answer and the caller would block forever.
+func mirrorParse(backend net.Conn, parseMessage []byte) error {
+	if _, err := connect.Send(backend, parseMessage); err != nil {
+		return err
+	}
+
+	if _, err := connect.Send(backend, protocol.CreateSyncMessage()); err != nil {
+		return err
+	}
+
+	for {
+		message, length, err := connect.Receive(backend)
+		if err != nil {
+			return err
+		}
+
+		for start := 0; start < length; {
+			messageType := protocol.GetMessageType(message[start:])
+			messageLength := protocol.GetMessageLength(message[start:])
+			start = start + int(messageLength) + 1
+
+			if messageType == protocol.ReadyForQueryMessageType {
+				return nil
+			}
+		}
+	}
+}
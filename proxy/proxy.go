@@ -17,36 +17,76 @@ package proxy
 import (
 	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/fx-hao/crunchy-proxy/audit"
+	"github.com/fx-hao/crunchy-proxy/balancer"
 	"github.com/fx-hao/crunchy-proxy/common"
 	"github.com/fx-hao/crunchy-proxy/config"
 	"github.com/fx-hao/crunchy-proxy/connect"
+	"github.com/fx-hao/crunchy-proxy/health"
 	"github.com/fx-hao/crunchy-proxy/pool"
 	"github.com/fx-hao/crunchy-proxy/protocol"
 	"github.com/fx-hao/crunchy-proxy/util/log"
 )
 
 type Proxy struct {
-	writePools chan *pool.Pool
-	readPools  chan *pool.Pool
-	master     common.Node
-	clients    []net.Conn
-	Stats      map[string]int32
-	lock       *sync.Mutex
+	writePools   chan *pool.Pool
+	readBalancer balancer.Strategy
+	master       common.Node
+	masterName   string
+	clients      []net.Conn
+	Stats        map[string]int32
+	lock         *sync.Mutex
+	audit        *audit.Logger
+	health       *health.Checker
+	draining     map[string]bool
 }
 
+// nextSessionID is a monotonically increasing counter used to give each
+// audited session a stable identifier for the lifetime of the proxy
+// process.
+var nextSessionID uint64
+
 func NewProxy() *Proxy {
 	p := &Proxy{
-		Stats: make(map[string]int32),
-		lock:  &sync.Mutex{},
+		Stats:        make(map[string]int32),
+		lock:         &sync.Mutex{},
+		audit:        audit.NewLogger(),
+		readBalancer: balancer.New(config.GetString("balancer.strategy")),
+		health: health.NewChecker(
+			config.GetDuration("health.interval"),
+			config.GetInt64("health.max_lag_bytes"),
+		),
 	}
 
+	p.health.OnMasterLoss(p.promoteReplica)
+	p.health.OnUpdate(p.onHealthUpdate)
+
 	p.setupPools()
 
+	go p.health.Start()
+
 	return p
 }
 
+// onHealthUpdate mirrors the health checker's latest view of a node
+// into the read balancer, so a strategy such as LowestLag or one that
+// skips unhealthy pools stays current without polling the checker
+// itself. It is a no-op for names the balancer doesn't know about,
+// e.g. the master. SetHealthy is fed p.health.IsHealthy rather than
+// status.Healthy directly, so a replica whose lag has crossed
+// `health.max_lag_bytes` drops out of read rotation the same way
+// getWritePool already excludes it from writes. A node DrainNode has
+// marked draining is kept unhealthy here until the drain ends.
+func (p *Proxy) onHealthUpdate(name string, status health.Status) {
+	p.readBalancer.SetHealthy(name, p.health.IsHealthy(name) && !p.isDraining(name))
+	p.readBalancer.SetLag(name, status.LagBytes)
+}
+
 func (p *Proxy) setupPools() {
 	nodes := config.GetNodes()
 	capacity := config.GetPoolCapacity()
@@ -54,70 +94,252 @@ func (p *Proxy) setupPools() {
 	/* Initialize pool structures */
 	numNodes := len(nodes)
 	p.writePools = make(chan *pool.Pool, numNodes)
-	p.readPools = make(chan *pool.Pool, numNodes)
 
 	for name, node := range nodes {
-		/* Create Pool for Node */
-		newPool := pool.NewPool(name, capacity)
+		newPool := p.connectPool(name, node, capacity)
 
 		if node.Role == common.NODE_ROLE_MASTER {
 			p.writePools <- newPool
+			p.masterName = name
 		} else {
-			p.readPools <- newPool
+			p.readBalancer.Register(name, newPool, 1)
 		}
 
-		/* Create connections and add to pool. */
-		for i := 0; i < capacity; i++ {
-			/* Connect and authenticate */
-			log.Infof("Connecting to node '%s' at %s...", name, node.HostPort)
-			connection, err := connect.Connect(node.HostPort)
+		p.health.Register(name, node.Role, newPool)
+	}
+}
 
-			username := config.GetString("credentials.username")
-			database := config.GetString("credentials.database")
-			options := config.GetStringMapString("credentials.options")
+// connectPool creates a Pool for node and connects and authenticates
+// capacity backend connections into it. It is used both by
+// setupPools at startup and by AddPool to bring a node online at
+// runtime.
+func (p *Proxy) connectPool(name string, node common.Node, capacity int) *pool.Pool {
+	newPool := pool.NewPool(name, capacity)
 
-			startupMessage := protocol.CreateStartupMessage(username, database, options)
+	/* Create connections and add to pool. */
+	for i := 0; i < capacity; i++ {
+		/* Connect and authenticate */
+		log.Infof("Connecting to node '%s' at %s...", name, node.HostPort)
+		connection, err := connect.Connect(node.HostPort)
 
-			connection.Write(startupMessage)
+		username := config.GetString("credentials.username")
+		database := config.GetString("credentials.database")
+		options := config.GetStringMapString("credentials.options")
 
-			response := make([]byte, 4096)
-			connection.Read(response)
+		startupMessage := protocol.CreateStartupMessage(username, database, options)
 
-			authenticated := connect.HandleAuthenticationRequest(connection, response)
+		connection.Write(startupMessage)
 
-			if !authenticated {
-				log.Error("Authentication failed")
-			}
+		response := make([]byte, 4096)
+		connection.Read(response)
 
-			if err != nil {
-				log.Errorf("Error establishing connection to node '%s'", name)
-				log.Errorf("Error: %s", err.Error())
-			} else {
-				log.Infof("Successfully connected to '%s' at '%s'", name, node.HostPort)
-				newPool.Add(connection)
-			}
+		authenticated := connect.HandleAuthenticationRequest(connection, response)
+
+		if !authenticated {
+			log.Error("Authentication failed")
+		}
+
+		if err != nil {
+			log.Errorf("Error establishing connection to node '%s'", name)
+			log.Errorf("Error: %s", err.Error())
+		} else {
+			log.Infof("Successfully connected to '%s' at '%s'", name, node.HostPort)
+			newPool.Add(connection)
 		}
 	}
+
+	return newPool
 }
 
-// Get the next pool. If read is set to true, then a 'read-only' pool will be
-// returned. Otherwise, a 'read-write' pool will be returned.
-func (p *Proxy) getPool(read bool) *pool.Pool {
-	if read {
-		return <-p.readPools
+// AddPool brings node online at runtime: it connects a fresh pool for
+// it, registers it with the health checker, and adds it to the
+// read or write collection of pools according to node.Role.
+func (p *Proxy) AddPool(name string, node common.Node) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	newPool := p.connectPool(name, node, config.GetPoolCapacity())
+
+	if node.Role == common.NODE_ROLE_MASTER {
+		p.writePools = growPools(p.writePools, newPool)
+		p.masterName = name
+	} else {
+		p.readBalancer.Register(name, newPool, 1)
+	}
+
+	p.health.Register(name, node.Role, newPool)
+}
+
+// RemovePool takes node out of rotation, removing it from whichever
+// collection of pools it belongs to and from the health checker.
+func (p *Proxy) RemovePool(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.writePools, _ = extractPool(p.writePools, name)
+	p.readBalancer.Unregister(name)
+	p.health.Unregister(name)
+}
+
+// promoteReplica is invoked by the health checker when the master is
+// found unhealthy; it moves the named replica pool out of the read
+// balancer into writePools so subsequent writes are routed to it.
+//
+// It also retires the old master: its pool is dropped from writePools
+// and its health registration removed, and the promoted replica is
+// re-registered with the health checker under the master role. Without
+// this, the dead master stays registered as MASTER and unhealthy
+// forever, so checkMasterLoss would keep firing on every subsequent
+// tick and promoteReplica would keep promoting further replicas out
+// from under a master that's already been replaced.
+func (p *Proxy) promoteReplica(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if name == p.masterName {
+		// Already promoted on a previous tick; nothing left to do.
+		return
+	}
+
+	promoted, ok := p.readBalancer.Lookup(name)
+	if !ok {
+		log.Errorf("Cannot promote '%s': not found among read pools", name)
+		return
+	}
+
+	oldMaster := p.masterName
+
+	p.readBalancer.Unregister(name)
+	p.writePools, _ = extractPool(p.writePools, oldMaster)
+	p.writePools = growPools(p.writePools, promoted)
+	p.masterName = name
+
+	p.health.Unregister(oldMaster)
+	p.health.Register(name, common.NODE_ROLE_MASTER, promoted)
+
+	log.Infof("Promoted replica '%s' to master after master loss", name)
+}
+
+// drainPools empties pools into a slice without blocking, leaving the
+// channel ready to be replaced.
+func drainPools(pools chan *pool.Pool) []*pool.Pool {
+	var drained []*pool.Pool
+
+	for {
+		select {
+		case pl := <-pools:
+			drained = append(drained, pl)
+		default:
+			return drained
+		}
+	}
+}
+
+// growPools returns a new channel containing every pool already in
+// pools plus added, sized to fit them all. The channels handed out by
+// setupPools are sized to the node count known at startup, so adding a
+// pool at runtime requires a bigger channel.
+func growPools(pools chan *pool.Pool, added *pool.Pool) chan *pool.Pool {
+	existing := drainPools(pools)
+
+	grown := make(chan *pool.Pool, len(existing)+1)
+	for _, pl := range existing {
+		grown <- pl
+	}
+	grown <- added
+
+	return grown
+}
+
+// extractPool returns a new channel containing every pool in pools
+// except the one named name, along with that removed pool (nil if no
+// pool by that name was found).
+func extractPool(pools chan *pool.Pool, name string) (chan *pool.Pool, *pool.Pool) {
+	existing := drainPools(pools)
+
+	remaining := make(chan *pool.Pool, len(existing))
+	var removed *pool.Pool
+
+	for _, pl := range existing {
+		if pl.Name == name && removed == nil {
+			removed = pl
+			continue
+		}
+		remaining <- pl
+	}
+
+	return remaining, removed
+}
+
+// Get the next pool. If read is set to true, then a 'read-only' pool is
+// selected by the configured balancer.Strategy, using annotation (the
+// `/* shard=<key> */` comment on the query, if any) for strategies such
+// as ConsistentHash that route on it. Otherwise, a 'read-write' pool is
+// pulled off the write channel as before.
+func (p *Proxy) getPool(read bool, annotation string) *pool.Pool {
+	if !read {
+		return p.getWritePool()
+	}
+
+	for {
+		pl, err := p.readBalancer.Next(annotation)
+		if err == nil {
+			return pl
+		}
+
+		log.Errorf("Error selecting a read pool: %s", err.Error())
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (p *Proxy) getWritePool() *pool.Pool {
+	/*
+	 * AddPool/RemovePool/promoteReplica replace p.writePools outright
+	 * (growPools/extractPool build a new channel), so the field itself
+	 * must only be touched under p.lock. Snapshot the channel here and
+	 * operate on that local copy -- the channel value stays perfectly
+	 * usable even after a later reassignment repoints the field.
+	 */
+	p.lock.Lock()
+	pools := p.writePools
+	p.lock.Unlock()
+
+	attempts := cap(pools)
+	if attempts == 0 {
+		attempts = 1
+	}
+
+	/*
+	 * Pools whose node has gone unhealthy, or whose replication lag has
+	 * crossed the configured threshold, or that are being drained, are
+	 * skipped and put back so a later probe can clear them. If every pool
+	 * is currently unhealthy or draining, fall back to whichever comes up
+	 * rather than blocking forever.
+	 */
+	for i := 0; i < attempts; i++ {
+		pl := <-pools
+		if p.health.IsHealthy(pl.Name) && !p.isDraining(pl.Name) {
+			return pl
+		}
+		pools <- pl
 	}
-	return <-p.writePools
+
+	return <-pools
 }
 
-// Return the pool. If read is 'true' then, the pool will be returned to the
-// 'read-only' collection of pools. Otherwise, it will be returned to the
-// 'read-write' collection of pools.
+// Return the pool. Write pools are returned to the 'read-write' channel
+// as before. Read pools aren't checked out of anything -- the balancer
+// registry just answers Next() again -- so returning one is a no-op.
 func (p *Proxy) returnPool(pl *pool.Pool, read bool) {
 	if read {
-		p.readPools <- pl
-	} else {
-		p.writePools <- pl
+		return
 	}
+
+	p.lock.Lock()
+	pools := p.writePools
+	p.lock.Unlock()
+
+	pools <- pl
 }
 
 // HandleConnection handle an incoming connection to the proxy
@@ -200,6 +422,31 @@ func (p *Proxy) HandleConnection(client net.Conn) {
 		log.Debugf("Client: %s - authentication successful", client.RemoteAddr())
 	}
 
+	/*
+	 * The client is now fully authenticated and ready to issue statements.
+	 * Record the session's opening for the audit trail, and make sure its
+	 * closing is recorded no matter which path out of this function is
+	 * taken.
+	 */
+	creds := config.GetCredentials()
+	sessionID := strconv.FormatUint(atomic.AddUint64(&nextSessionID, 1), 10)
+
+	p.audit.Log(audit.Event{
+		Type:       audit.EventConnect,
+		SessionID:  sessionID,
+		ClientAddr: client.RemoteAddr().String(),
+		Username:   creds.Username,
+		Database:   creds.Database,
+	})
+
+	defer p.audit.Log(audit.Event{
+		Type:       audit.EventDisconnect,
+		SessionID:  sessionID,
+		ClientAddr: client.RemoteAddr().String(),
+		Username:   creds.Username,
+		Database:   creds.Database,
+	})
+
 	/* Process the client messages for the life of the connection. */
 	var statementBlock bool
 	var cp *pool.Pool    // The connection pool in use
@@ -207,6 +454,15 @@ func (p *Proxy) HandleConnection(client net.Conn) {
 	var read bool
 	var end bool
 	var nodeName string
+	var extendedQueryText string // the SQL text behind the pinned extended-protocol sequence
+
+	/*
+	 * Tracks prepared statements and portals created via the extended
+	 * query protocol (Parse/Bind/Describe/Execute/Sync), so the proxy
+	 * keeps annotation-based routing working for JDBC/psycopg/pgx
+	 * clients that never send a plain 'Q' message.
+	 */
+	eqs := protocol.NewExtendedQueryState()
 
 	for {
 		var done bool // for message processing loop.
@@ -246,12 +502,14 @@ func (p *Proxy) HandleConnection(client net.Conn) {
 
 			read = annotations[ReadAnnotation]
 
+			queryText := protocol.GetQueryString(message)
+
 			/*
 			 * If not in a statement block or if the pool or backend are not already
 			 * set, then fetch a new backend to receive the message.
 			 */
 			if !statementBlock && !end || cp == nil || backend == nil {
-				cp = p.getPool(read)
+				cp = p.getPool(read, shardKey(queryText))
 				backend = cp.Next()
 				nodeName = cp.Name
 				p.returnPool(cp, read)
@@ -268,6 +526,15 @@ func (p *Proxy) HandleConnection(client net.Conn) {
 				log.Debugf("Error: %s", err.Error())
 			}
 
+			/*
+			 * Track the outcome of the statement as the backend's response is
+			 * relayed back, so a single audit event can be logged once the
+			 * statement completes.
+			 */
+			var rowCount int64
+			var rowCountKnown bool
+			var statementErr string
+
 			/*
 			 * Continue to read from the backend until a 'ReadyForQuery' message is
 			 * is found.
@@ -289,6 +556,16 @@ func (p *Proxy) HandleConnection(client net.Conn) {
 					messageType = protocol.GetMessageType(message[start:])
 					messageLength := protocol.GetMessageLength(message[start:])
 
+					switch messageType {
+					case protocol.CommandCompleteMessageType:
+						if count, ok := commandCompleteRowCount(message[start:]); ok {
+							rowCount = count
+							rowCountKnown = true
+						}
+					case protocol.ErrorResponseMessageType:
+						statementErr = errorResponseMessage(message[start:])
+					}
+
 					/*
 					 * Calculate the next start position, add '1' to the message
 					 * length to account for the message type.
@@ -305,6 +582,21 @@ func (p *Proxy) HandleConnection(client net.Conn) {
 				done = (messageType == protocol.ReadyForQueryMessageType)
 			}
 
+			auditEvent := audit.Event{
+				Type:      audit.EventStatement,
+				SessionID: sessionID,
+				Username:  creds.Username,
+				Database:  creds.Database,
+				Node:      nodeName,
+				Statement: audit.StatementSimpleQuery,
+				Query:     queryText,
+				Error:     statementErr,
+			}
+			if rowCountKnown {
+				auditEvent.RowCount = rowCount
+			}
+			p.audit.Log(auditEvent)
+
 			/*
 			 * If at the end of a statement block or not part of statment block,
 			 * then return the connection to the pool.
@@ -321,6 +613,138 @@ func (p *Proxy) HandleConnection(client net.Conn) {
 				/* Return the backend to the pool it belongs to. */
 				cp.Return(backend)
 			}
+		} else if isExtendedProtocolMessageType(messageType) {
+			/*
+			 * Extended-protocol clients replace the single 'Q' message with a
+			 * Parse -> Bind -> Describe -> Execute -> Sync sequence. Track
+			 * statements/portals as they're created so annotations on the
+			 * original Parse'd SQL still steer routing, and pin one backend
+			 * for the whole sequence so it doesn't get released until Sync
+			 * completes.
+			 */
+			switch messageType {
+			case protocol.ParseMessageType:
+				stmt := eqs.HandleParse(message[:length])
+				read = getAnnotations(protocol.CreateQueryMessage(stmt.Query))[ReadAnnotation]
+				extendedQueryText = stmt.Query
+			case protocol.BindMessageType:
+				portal := eqs.HandleBind(message[:length])
+				if stmt := eqs.StatementForPortal(portal.Name); stmt != nil {
+					extendedQueryText = stmt.Query
+				}
+			case protocol.CloseMessageType:
+				eqs.HandleClose(message[:length])
+			}
+
+			if cp == nil || backend == nil {
+				cp = p.getPool(read, shardKey(extendedQueryText))
+				backend = cp.Next()
+				nodeName = cp.Name
+				p.returnPool(cp, read)
+			}
+
+			p.lock.Lock()
+			p.Stats[nodeName] += 1
+			p.lock.Unlock()
+
+			if messageType == protocol.ParseMessageType {
+				mirrorParseToPool(cp, backend, message[:length])
+
+				p.audit.Log(audit.Event{
+					Type:      audit.EventStatement,
+					SessionID: sessionID,
+					Username:  creds.Username,
+					Database:  creds.Database,
+					Node:      nodeName,
+					Statement: audit.StatementParse,
+					Query:     extendedQueryText,
+				})
+			}
+
+			if _, err = connect.Send(backend, message[:length]); err != nil {
+				log.Debugf("Error sending message to backend %s", backend.RemoteAddr())
+				log.Debugf("Error: %s", err.Error())
+			}
+
+			switch messageType {
+			case protocol.SyncMessageType:
+				/*
+				 * Sync is the only extended-protocol message that
+				 * guarantees a ReadyForQuery in response, so it's the only
+				 * point at which the backend can be safely released. It's
+				 * also the point at which the CommandComplete/ErrorResponse
+				 * for whatever Execute preceded it is guaranteed to have
+				 * arrived, so the statement's outcome is captured here for
+				 * the audit trail.
+				 */
+				var rowCount int64
+				var rowCountKnown bool
+				var statementErr string
+
+				for !done {
+					var lastType byte
+
+					if message, length, err = connect.Receive(backend); err != nil {
+						log.Debugf("Error receiving response from backend %s", backend.RemoteAddr())
+						log.Debugf("Error: %s", err.Error())
+						done = true
+					}
+
+					for start := 0; start < length; {
+						lastType = protocol.GetMessageType(message[start:])
+						messageLength := protocol.GetMessageLength(message[start:])
+
+						switch lastType {
+						case protocol.CommandCompleteMessageType:
+							if count, ok := commandCompleteRowCount(message[start:]); ok {
+								rowCount = count
+								rowCountKnown = true
+							}
+						case protocol.ErrorResponseMessageType:
+							statementErr = errorResponseMessage(message[start:])
+						}
+
+						start = (start + int(messageLength) + 1)
+					}
+
+					if _, err = connect.Send(client, message[:length]); err != nil {
+						log.Debugf("Error sending response to client %s", client.RemoteAddr())
+						log.Debugf("Error: %s", err.Error())
+						done = true
+					}
+
+					done = done || lastType == protocol.ReadyForQueryMessageType
+				}
+
+				auditEvent := audit.Event{
+					Type:      audit.EventStatement,
+					SessionID: sessionID,
+					Username:  creds.Username,
+					Database:  creds.Database,
+					Node:      nodeName,
+					Statement: audit.StatementExecute,
+					Query:     extendedQueryText,
+					Error:     statementErr,
+				}
+				if rowCountKnown {
+					auditEvent.RowCount = rowCount
+				}
+				p.audit.Log(auditEvent)
+
+				cp.Return(backend)
+				cp = nil
+				backend = nil
+				extendedQueryText = ""
+			case protocol.FlushMessageType:
+				/*
+				 * Flush asks the backend to send whatever it already owes
+				 * the client without a Sync; relay it but keep the backend
+				 * pinned since the sequence isn't over.
+				 */
+				if message, length, err = connect.Receive(backend); err == nil {
+					connect.Send(client, message[:length])
+				}
+			}
 		}
 	}
 }
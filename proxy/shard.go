@@ -0,0 +1,34 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import "regexp"
+
+// shardAnnotationPattern matches a `/* shard=<key> */` comment, the
+// same style of annotation comment already used for read/write/
+// statement-block hints, letting a client pin a logical session to the
+// same replica across queries via balancer.ConsistentHash.
+var shardAnnotationPattern = regexp.MustCompile(`/\*\s*shard=(\S+?)\s*\*/`)
+
+// shardKey extracts the shard annotation's value from query, or ""
+// if it carries none.
+func shardKey(query string) string {
+	match := shardAnnotationPattern.FindStringSubmatch(query)
+	if match == nil {
+		return ""
+	}
+
+	return match[1]
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tls lets the proxy terminate client TLS connections itself,
+// minting short-lived leaf certificates on the fly for whatever host the
+// client asked for and signing them with a single configured CA. This is
+// the same certificate-minting approach used by MITM HTTPS proxies: the
+// CA is trusted once by the client, and every leaf after that is issued
+// transparently.
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// CA is the certificate authority the proxy uses to sign leaf
+// certificates for incoming client connections.
+type CA struct {
+	Cert    *x509.Certificate
+	Key     interface{}
+	rawCert tls.Certificate
+}
+
+// LoadCA reads a PEM-encoded certificate and private key from disk and
+// returns a CA that can mint leaf certificates signed by it.
+func LoadCA(certPath, keyPath string) (*CA, error) {
+	rawCert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(rawCert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{
+		Cert:    cert,
+		Key:     rawCert.PrivateKey,
+		rawCert: rawCert,
+	}, nil
+}
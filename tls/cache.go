@@ -0,0 +1,104 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+// defaultCacheSize bounds how many distinct leaf certificates are kept
+// in memory at once, evicting the least-recently-used host once the
+// limit is reached.
+const defaultCacheSize = 1024
+
+// Cache mints and caches leaf certificates signed by a CA, keyed by the
+// SNI hostname the client requested. It is safe for concurrent use.
+type Cache struct {
+	ca      *CA
+	size    int
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type cacheEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+// NewCache returns a Cache that mints leaves signed by ca and keeps at
+// most size of them in memory. A size <= 0 uses defaultCacheSize.
+func NewCache(ca *CA, size int) *Cache {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+
+	return &Cache{
+		ca:      ca,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get returns the cached leaf certificate for host, minting and caching
+// a new one signed by the configured CA if none is cached yet or the
+// cached one has expired.
+func (c *Cache) Get(host string) (*tls.Certificate, error) {
+	c.lock.Lock()
+
+	if elem, ok := c.entries[host]; ok {
+		cert := elem.Value.(*cacheEntry).cert
+		if time.Now().Before(cert.Leaf.NotAfter) {
+			c.order.MoveToFront(elem)
+			c.lock.Unlock()
+			return cert, nil
+		}
+
+		c.order.Remove(elem)
+		delete(c.entries, host)
+	}
+
+	c.lock.Unlock()
+
+	cert, err := c.ca.mintLeaf(host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	/* Another goroutine may have minted the same host's leaf while this
+	 * one was generating its own; prefer whichever is already cached. */
+	if elem, ok := c.entries[host]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).cert, nil
+	}
+
+	elem := c.order.PushFront(&cacheEntry{host: host, cert: cert})
+	c.entries[host] = elem
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).host)
+	}
+
+	return cert, nil
+}
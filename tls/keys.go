@@ -0,0 +1,61 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"sync"
+)
+
+// keyRing lazily generates one RSA and one ECDSA key pair and hands the
+// same pair to every leaf certificate minted afterwards. Generating a
+// fresh key per connection is the expensive part of minting a
+// certificate; reusing a pair is safe here because the certificates
+// that matter for trust are the per-host leaves, not the keys backing
+// them.
+type keyRing struct {
+	once     sync.Once
+	rsaKey   *rsa.PrivateKey
+	ecdsaKey *ecdsa.PrivateKey
+	err      error
+}
+
+var defaultKeyRing keyRing
+
+func (k *keyRing) init() {
+	k.rsaKey, k.err = rsa.GenerateKey(rand.Reader, 2048)
+	if k.err != nil {
+		return
+	}
+
+	k.ecdsaKey, k.err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// rsaLeafKey returns the shared RSA key used to back RSA leaf
+// certificates.
+func rsaLeafKey() (*rsa.PrivateKey, error) {
+	defaultKeyRing.once.Do(defaultKeyRing.init)
+	return defaultKeyRing.rsaKey, defaultKeyRing.err
+}
+
+// ecdsaLeafKey returns the shared ECDSA key used to back ECDSA leaf
+// certificates.
+func ecdsaLeafKey() (*ecdsa.PrivateKey, error) {
+	defaultKeyRing.once.Do(defaultKeyRing.init)
+	return defaultKeyRing.ecdsaKey, defaultKeyRing.err
+}
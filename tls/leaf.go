@@ -0,0 +1,94 @@
+/*
+Copyright 2017 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"time"
+)
+
+// leafLifetime is how long a minted leaf certificate is valid for. It
+// bounds the life of each certificate, not of the key behind it: every
+// leaf reuses the same shared key (see keyRing) for the life of the
+// process. Leaves are cached in memory only, and Cache.Get mints a fresh
+// one once a cached leaf has expired.
+const leafLifetime = 24 * time.Hour
+
+var maxSerialNumber = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// mintLeaf generates and signs, with ca, a new leaf certificate for
+// host. It returns a tls.Certificate ready to hand to a
+// tls.Config.GetCertificate callback.
+func (ca *CA) mintLeaf(host string) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, maxSerialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := leafKeyFor(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: host,
+		},
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              now.Add(leafLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Cert.Raw},
+		PrivateKey:  key,
+		Leaf:        template,
+	}, nil
+}
+
+// leafKeyFor returns the shared leaf key matching ca's own key type, so
+// an ECDSA CA signs ECDSA leaves and anything else (including RSA)
+// gets the RSA leaf, rather than always minting an RSA leaf regardless
+// of what signed it.
+func leafKeyFor(ca *CA) (crypto.Signer, error) {
+	if _, ok := ca.Key.(*ecdsa.PrivateKey); ok {
+		return ecdsaLeafKey()
+	}
+
+	return rsaLeafKey()
+}